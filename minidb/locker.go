@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+/* LockID identifies a lock acquired via Reserve or Set. noLock, its zero
+	value, is never a valid credential: Update/Refresh/Delete reject it
+	outright before ever comparing it against the lock currently held, so
+	a caller that omits lock_id (e.g. a bulk update whose JSON leaves it
+	blank) can never match an entry that simply isn't locked yet. */
+type LockID string
+
+const noLock LockID = ""
+
+/* Sentinel errors a Locker implementation returns so the HTTP layer can
+	translate a backend failure into the right status code without
+	depending on which backend (in-memory map, Redis, ...) produced it */
+var (
+	ErrKeyNotFound    = errors.New("key does not exist")
+	ErrLockMismatch   = errors.New("lock_id does not match the currently held lock")
+	ErrLockExpired    = errors.New("lock has expired")
+	ErrKeyDeleted     = errors.New("key was deleted while this caller was waiting on it")
+	ErrInvalidLockID  = errors.New("lock_id is required")
+	ErrReserveTimeout = errors.New("timed out waiting to acquire lock")
+	ErrLockerClosed   = errors.New("locker is shutting down")
+)
+
+/* Locker is the storage/locking backend a Server delegates every key
+	operation to. It mirrors the lease-based API of NetLocker-style
+	distributed lock services: Reserve and Set block the caller until the
+	lock they need is free, Update writes a value under a held lock and
+	optionally releases it, Refresh extends a lease, and Delete removes a
+	key outright. Swapping the in-memory implementation for one backed by
+	a shared store (e.g. Redis) lets a fleet of Servers serve the same
+	keyspace instead of each holding an independent process-local map. */
+type Locker interface {
+	// Reserve blocks until key's lock is free and then claims it,
+	// returning a freshly issued LockID and the key's current value. If
+	// deadline is the zero Time, Reserve waits indefinitely; otherwise it
+	// gives up and returns ErrReserveTimeout once deadline has passed.
+	// Returns ErrKeyNotFound if the key has never been Set, or
+	// ErrKeyDeleted if it was removed by a concurrent Delete while this
+	// call was waiting.
+	Reserve(key string, deadline time.Time) (lockID LockID, value string, err error)
+
+	// Set creates key if it doesn't exist, or blocks until its existing
+	// lock is free, and stores value under a freshly issued LockID.
+	Set(key, value string) (lockID LockID, err error)
+
+	// Update writes value to key under lockID, releasing the lock
+	// afterwards when release is true. Returns ErrInvalidLockID if lockID
+	// is noLock, ErrLockMismatch if it isn't the one currently held, or
+	// ErrLockExpired if it is still recorded but its lease has elapsed. A
+	// lock whose expiry has already been cleared (by MemoryLocker's
+	// sweeper, or by Redis expiring the key) yields ErrLockMismatch.
+	Update(key string, lockID LockID, value string, release bool) error
+
+	// Refresh extends the lease on a lock the caller already holds.
+	Refresh(key string, lockID LockID) error
+
+	// Delete removes key outright, provided lockID matches the lock
+	// currently held on it. Any other caller concurrently blocked in
+	// Reserve on this key observes ErrKeyDeleted rather than acting on a
+	// key that no longer exists; a caller blocked in Set creates the key
+	// afresh instead.
+	Delete(key string, lockID LockID) error
+
+	// Close wakes any caller currently blocked in Reserve or Set so it
+	// returns ErrLockerClosed, and stops whatever background goroutines
+	// the implementation runs (e.g. an expiry sweeper). Server calls this
+	// once, while shutting down. RedisLocker's Close does nothing: its
+	// polling Reserve and Set calls do not return ErrLockerClosed.
+	Close()
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -12,58 +14,104 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
 )
 
-/*  An Entry in the Cache storage, storing state
-	of the value as well as the current LockID */
-type Entry struct {
-	sync.RWMutex
-	cond *sync.Cond
-	value string
-	lockID string
-}
+/* How long a client may hold a lock before it is considered
+	abandoned and auto-released */
+const lockTTL = 30 * time.Second
+
+/* How long a bulk reservation will wait for each key's lock before
+	giving up and releasing everything it already acquired */
+const defaultBulkTimeout = 10 * time.Second
 
 /* A helper struct in order to marshal some JSON */
 type Response struct {
-    LockID  string				   `json:"lock_id,omitempty"`
+    LockID  LockID				   `json:"lock_id,omitempty"`
     Value   string				   `json:"value,omitempty"`
 }
 
-/* A lockable cache since map has no concurrent safety */
-type Cache struct {
-	sync.RWMutex
-	storage map[string]*Entry
+/* Request body for POST /reservations: the flat list of keys to lock
+	together as a single atomic reservation */
+type BulkReservationRequest struct {
+	Keys []string `json:"keys"`
+}
+
+/* Request body for POST /values: a map of key to the lock_id/value pair
+	held for that key, released together when Release is set */
+type BulkUpdateRequest struct {
+	Release bool						   `json:"release"`
+	Entries map[string]BulkEntryUpdate	   `json:"entries"`
+}
+
+type BulkEntryUpdate struct {
+	LockID LockID `json:"lock_id"`
+	Value  string `json:"value"`
 }
 
 type Server struct {
-	cache	*Cache
-	router   *mux.Router
-	listener net.Listener
+	locker	   Locker
+	router     *mux.Router
+	listener   net.Listener
+	httpServer *http.Server
 }
 
-/* Create new server and instantiate the cache */
-func NewServer() (server *Server, err error) {
+/* Create new server backed by the given Locker */
+func NewServer(locker Locker) (server *Server, err error) {
 	server = new(Server)
+	server.locker = locker
 	router := mux.NewRouter()
 
+	bulkReserveRoute := router.HandleFunc("/reservations", server.handleBulkReservation)
+	bulkReserveRoute.Methods("POST")
+
 	reserveRoute := router.HandleFunc("/reservations/{key}", server.handleReservation)
 	reserveRoute.Methods("POST")
 
+	refreshRoute := router.HandleFunc("/reservations/{key}/{lock_id}/refresh", server.handleRefresh)
+	refreshRoute.Methods("POST")
+
+	bulkUpdateRoute := router.HandleFunc("/values", server.handleBulkUpdate)
+	bulkUpdateRoute.Methods("POST")
+
 	updateRoute := router.HandleFunc("/values/{key}/{lock_id}", server.handleUpdate)
 	updateRoute.Methods("POST")
 
+	deleteRoute := router.HandleFunc("/values/{key}/{lock_id}", server.handleDelete)
+	deleteRoute.Methods("DELETE")
+
 	setRoute := router.HandleFunc("/values/{key}", server.handleSet)
 	setRoute.Methods("PUT")
 
 	router.NotFoundHandler = http.HandlerFunc(server.defaultCall)
 	server.router = router
 
-	server.cache = new(Cache)
-	server.cache.storage = make(map[string]*Entry)
 	return server, nil
 }
 
+/* Listen binds addr, making the server's address available via Addr
+	immediately (e.g. ":0" so tests can bind an ephemeral port and read
+	back which one they got) instead of only once the blocking Start has
+	gotten around to it. Start requires Listen to have been called first. */
+func (self *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	self.listener = listener
+	return nil
+}
+
+/* Addr returns the address the server is listening on. Listen must have
+	been called first. */
+func (self *Server) Addr() net.Addr {
+	return self.listener.Addr()
+}
+
 /* Helper error function */
 func (self *Server) sendError(res http.ResponseWriter, msg string, code int) {
 	http.Error(res, "{\"error\": \"" + msg + "\"}", code)
@@ -74,33 +122,117 @@ func (self *Server) defaultCall(res http.ResponseWriter, req *http.Request) {
 	self.sendError(res, "This is not what you are looking for :/", http.StatusNotFound)
 }
 
+/* sendLockerError translates a sentinel error returned by the Locker into
+	the appropriate HTTP response, since the underlying backend shouldn't
+	leak into transport concerns. notFoundMsg lets callers keep their
+	existing wording for the ErrKeyNotFound case. */
+func (self *Server) sendLockerError(res http.ResponseWriter, err error, notFoundMsg string) {
+	switch err {
+	case ErrKeyNotFound:
+		self.sendError(res, notFoundMsg, http.StatusNotFound)
+	case ErrLockMismatch:
+		self.sendError(res, "Your lock id isn't consistent with the currently held lock", http.StatusUnauthorized)
+	case ErrLockExpired:
+		self.sendError(res, "Your lock has expired", http.StatusLocked)
+	case ErrKeyDeleted:
+		self.sendError(res, "This key was deleted", http.StatusGone)
+	case ErrInvalidLockID:
+		self.sendError(res, "lock_id is required", http.StatusBadRequest)
+	case ErrLockerClosed:
+		self.sendError(res, "Server is shutting down", http.StatusServiceUnavailable)
+	case ErrReserveTimeout:
+		self.sendError(res, "Timed out waiting to acquire all requested locks", http.StatusRequestTimeout)
+	default:
+		self.sendError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 /* Handle lock acquisition and value read as defined in the documentation */
 func (self *Server) handleReservation(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	key := vars["key"]
 
-	// Protect multiple go funcs from reading inconsistent map state
-	self.cache.RLock()
-	entry, ok := self.cache.storage[key]
-	self.cache.RUnlock()
+	lockID, value, err := self.locker.Reserve(key, time.Time{})
+	if err != nil {
+		self.sendLockerError(res, err, "Unable to claim lock on non-existent key")
+		return
+	}
 
-	// This is ok here since we do not support deletion of keys,
-	// if we were to support deletion of keys then the following
-	// wait on the lockID to change would be invalid as the entry
-	// may dissapear 
+	data, err := json.Marshal(Response{lockID, value})
+	if err != nil {
+		self.sendError(res, "Unable to marshal the response", http.StatusInternalServerError)
+		return
+	}
+	res.Write(data)
+}
 
-	if !ok {
-		self.sendError(res, "Unable to claim lock on non-existent key", http.StatusNotFound)
+/* dedupSorted removes adjacent duplicates from an already-sorted slice of
+	keys in place. A reservation request listing the same key twice would
+	otherwise try to acquire a lock it already holds and spin until its
+	own timeout, so bulk reservation dedups before acting. Bulk update needs
+	no dedup: it takes its keys from a map, which holds each key once. */
+func dedupSorted(keys []string) []string {
+	unique := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+/* Handle atomic multi-key lock acquisition. Keys are sorted lexicographically
+	before acquiring so two callers requesting an overlapping set in
+	different orders always acquire them in the same order and can never
+	deadlock against each other. If any single key's wait exceeds the
+	caller-supplied timeout, everything already acquired is released. */
+func (self *Server) handleBulkReservation(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		self.sendError(res, "Unable to read the body of the reservation request", http.StatusInternalServerError)
 		return
 	}
 
-	entry.Lock()
-	for entry.lockID != "" {
-		entry.cond.Wait()
+	var request BulkReservationRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		self.sendError(res, "Unable to parse the list of keys", http.StatusBadRequest)
+		return
 	}
-	entry.lockID = uuid()
-	entry.Unlock()
-	data, err := json.Marshal(Response{entry.lockID, entry.value})
+
+	timeout := defaultBulkTimeout
+	if raw, ok := req.URL.Query()["timeout"]; ok {
+		seconds, err := strconv.Atoi(raw[0])
+		if err != nil {
+			self.sendError(res, "timeout must be an integer number of seconds", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	keys := make([]string, len(request.Keys))
+	copy(keys, request.Keys)
+	sort.Strings(keys)
+	keys = dedupSorted(keys)
+
+	lockIDs := make(map[string]LockID, len(keys))
+	acquiredValues := make(map[string]string, len(keys))
+	acquiredKeys := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		lockID, value, err := self.locker.Reserve(key, time.Now().Add(timeout))
+		if err != nil {
+			for _, acquired := range acquiredKeys {
+				self.locker.Update(acquired, lockIDs[acquired], acquiredValues[acquired], true)
+			}
+			self.sendLockerError(res, err, "Unable to claim lock on non-existent key")
+			return
+		}
+		lockIDs[key] = lockID
+		acquiredValues[key] = value
+		acquiredKeys = append(acquiredKeys, key)
+	}
+
+	data, err := json.Marshal(lockIDs)
 	if err != nil {
 		self.sendError(res, "Unable to marshal the response", http.StatusInternalServerError)
 		return
@@ -108,13 +240,26 @@ func (self *Server) handleReservation(res http.ResponseWriter, req *http.Request
 	res.Write(data)
 }
 
+/* Handle lease refresh so a client that is still working can extend
+	its hold on a key before the lock expires out from under it */
+func (self *Server) handleRefresh(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	key := vars["key"]
+	lockID := LockID(vars["lock_id"])
+
+	if err := self.locker.Refresh(key, lockID); err != nil {
+		self.sendLockerError(res, err, "Unable to refresh lock on non-existent key")
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
 /* Handle update and unlocking as defined in the documentation provided */
 func (self *Server) handleUpdate(res http.ResponseWriter, req *http.Request) {
-
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		self.sendError(res, "Unable to read the body of the set request", http.StatusInternalServerError)
-		self.cache.Unlock()
 		return
 	}
 
@@ -125,27 +270,61 @@ func (self *Server) handleUpdate(res http.ResponseWriter, req *http.Request) {
 	}
 	vars := mux.Vars(req)
 	key := vars["key"]
-	lockID := vars["lock_id"]
+	lockID := LockID(vars["lock_id"])
+
+	err = self.locker.Update(key, lockID, string(body), len(release) > 0 && release[0] == "true")
+	if err != nil {
+		self.sendLockerError(res, err, "This key hasn't been created")
+		return
+	}
 
-	// Attain read only lock, since cache won't be mutated here
-	self.cache.RLock()
-	entry, ok := self.cache.storage[key]
-	self.cache.RUnlock()
+	res.WriteHeader(http.StatusNoContent)
+}
 
-	if !ok {
-		self.sendError(res, "This key hasn't been created", http.StatusNotFound)
+/* Handle key deletion. The deleted key can no longer be reserved,
+	updated, or refreshed until a later set creates it again; callers
+	already waiting in a reservation on it observe ErrKeyDeleted and
+	receive a 410 Gone rather than acting on a key that no longer exists. */
+func (self *Server) handleDelete(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	key := vars["key"]
+	lockID := LockID(vars["lock_id"])
+
+	if err := self.locker.Delete(key, lockID); err != nil {
+		self.sendLockerError(res, err, "This key hasn't been created")
 		return
 	}
-	if entry.lockID != lockID {
-		self.sendError(res, "Your lock id isn't consistent with the currently held lock", http.StatusUnauthorized)
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+/* Handle bulk update and release across several keys acquired together via
+	POST /reservations */
+func (self *Server) handleBulkUpdate(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		self.sendError(res, "Unable to read the body of the update request", http.StatusInternalServerError)
+		return
+	}
+
+	var request BulkUpdateRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		self.sendError(res, "Unable to parse the bulk update request", http.StatusBadRequest)
 		return
 	}
 
-	entry.value = string(body)
+	keys := make([]string, 0, len(request.Entries))
+	for key := range request.Entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	if len(release) > 0 && release[0] == "true" {
-		entry.cond.Broadcast()
-		entry.lockID = ""
+	for _, key := range keys {
+		update := request.Entries[key]
+		if err := self.locker.Update(key, update.LockID, update.Value, request.Release); err != nil {
+			self.sendLockerError(res, err, "This key hasn't been created")
+			return
+		}
 	}
 
 	res.WriteHeader(http.StatusNoContent)
@@ -159,34 +338,16 @@ func (self *Server) handleSet(res http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		self.sendError(res, "Unable to read the body of the set request", http.StatusInternalServerError)
-		self.cache.Unlock()
 		return
 	}
 
-	// Grab the WriteLock because we may mutate the dictionary
-	self.cache.Lock()
-	entry, ok := self.cache.storage[key]
-	if !ok {
-		entry = new(Entry)
-		entry.lockID = uuid() // Prevent any other routine from locking this
-		entry.cond = sync.NewCond(entry)
-		self.cache.storage[key] = entry
-	}
-	self.cache.Unlock()
-
-	entry.Lock()
-
-	// If this entry already existed, we wait until we can lock it
-	for ok && entry.lockID != "" {
-		entry.cond.Wait()
+	lockID, err := self.locker.Set(key, string(body))
+	if err != nil {
+		self.sendLockerError(res, err, "Unable to set non-existent key")
+		return
 	}
 
-	entry.lockID = uuid()
-	entry.value = string(body)
-
-	entry.Unlock()
-
-	data, err := json.Marshal(Response{entry.lockID, ""})
+	data, err := json.Marshal(Response{lockID, ""})
 	if err != nil {
 		self.sendError(res, "Unable to marshal the response", http.StatusInternalServerError)
 		return
@@ -194,53 +355,84 @@ func (self *Server) handleSet(res http.ResponseWriter, req *http.Request) {
 	res.Write(data)
 }
 
-func (self *Server) Start() (err error) {
-	listener, err := net.Listen("tcp", ":9999")
-	if err != nil { return err }
+/* Start serves on the listener bound by Listen until ctx is cancelled, at
+	which point it drains in-flight reservations and shuts the http.Server
+	down gracefully. Taking a context (rather than blocking on a channel
+	that is never written to) lets multiple Servers run in one process,
+	which tests rely on. Listen must be called first: Start only serves,
+	so a test can Listen synchronously, read back Addr(), and only then
+	run Start in a goroutine. */
+func (self *Server) Start(ctx context.Context) (err error) {
+	if self.listener == nil {
+		return fmt.Errorf("Start called before Listen")
+	}
 
-	log.Println("Starting server at port 9999")
-	self.listener = listener
-	http.Handle("/", self.router)
+	self.httpServer = &http.Server{Handler: self.router}
 
-	go http.Serve(self.listener, nil)
+	go func() {
+		<-ctx.Done()
+		self.shutdown()
+	}()
 
-	forever := make(chan bool)
-	<-forever
+	log.Println("Starting server at", self.listener.Addr())
+	err = self.httpServer.Serve(self.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
 
-	return nil
+/* shutdown closes the Locker so any caller blocked in Reserve or Set
+	observes it and returns 503, then gives the http.Server a bounded
+	window to finish any requests already in flight before closing the
+	listener */
+func (self *Server) shutdown() {
+	self.locker.Close()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	self.httpServer.Shutdown(shutdownCtx)
 }
 
 func main() {
-	server, err := NewServer()
+	locker := NewMemoryLocker()
+	server, err := NewServer(locker)
 	if err != nil {
 		log.Println("Critical failure", err)
 		return
 	}
-	err = server.Start()
-	if err != nil {
+
+	if err := server.Listen(":9999"); err != nil {
 		log.Println("Critical failure", err)
 		return
 	}
-}
 
-// UUID Functionality taken from google group
-// https://groups.google.com/forum/#!topic/golang-nuts/Rn13T6BZpgE
-var Random *os.File
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
 
-func uuid() string {
-	var err error
-	if Random == nil {
-		Random, err = os.Open("/dev/urandom")
-		if err != nil {
-			log.Fatal(err)
-		}
+	err = server.Start(ctx)
+	if err != nil {
+		log.Println("Critical failure", err)
+		return
 	}
+}
 
+// UUID Functionality adapted from the Go standard library's crypto/rand,
+// which generates each ID independently instead of sharing an
+// unsynchronized package-level *os.File across every caller
+// https://groups.google.com/forum/#!topic/golang-nuts/Rn13T6BZpgE
+func uuid() LockID {
 	b := make([]byte, 16)
-	Random.Read(b)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
 	b[6] = (b[6] & 0x0f) | 0x40
 	b[8] = (b[8] & 0x3f) | 0x80
-	return fmt.Sprintf("%x-%x-%x-%x-%x",
-	b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return LockID(fmt.Sprintf("%x-%x-%x-%x-%x",
+		b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
 }
-
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*  An Entry in the MemoryLocker's storage, storing state of the value
+	as well as the current lock_id and lease expiry. cond lets a caller
+	blocked in Reserve or Set sleep until the lock is released, cleared
+	by the expiry sweeper, or the entry is torn down, instead of polling.
+	deleted is a tombstone: a caller parked on cond.Wait() when Delete
+	removes this entry wakes up holding the same stale *Entry and checks
+	this rather than acting on a key that no longer exists. */
+type Entry struct {
+	sync.RWMutex
+	cond    *sync.Cond
+	value   string
+	lockID  LockID
+	expiry  time.Time
+	deleted bool
+}
+
+/* newEntry allocates an Entry with its cond wired up to its own lock */
+func newEntry() *Entry {
+	entry := new(Entry)
+	entry.cond = sync.NewCond(entry)
+	return entry
+}
+
+/* A lockable cache since map has no concurrent safety. closed is set once
+	by MemoryLocker.Close so any entry waiter that wakes afterwards knows
+	to give up rather than wait on a locker that is going away. */
+type memoryCache struct {
+	sync.RWMutex
+	storage map[string]*Entry
+	closed  bool
+}
+
+/* MemoryLocker is the default Locker: a process-local map of Entry,
+	guarded by per-entry locks, with a sweeper goroutine that auto-releases
+	any lock whose lease has elapsed so a client that crashed mid-reservation
+	doesn't wedge the key forever */
+type MemoryLocker struct {
+	cache *memoryCache
+	stop  chan struct{}
+}
+
+/* NewMemoryLocker creates an empty in-memory Locker and starts its
+	expiry sweeper */
+func NewMemoryLocker() *MemoryLocker {
+	locker := new(MemoryLocker)
+	locker.cache = &memoryCache{storage: make(map[string]*Entry)}
+	locker.stop = make(chan struct{})
+	go locker.sweepExpiredLocks()
+	return locker
+}
+
+func (self *MemoryLocker) isClosed() bool {
+	self.cache.RLock()
+	defer self.cache.RUnlock()
+	return self.cache.closed
+}
+
+/* armDeadline arranges for entry's cond to be broadcast once deadline
+	passes, so a waiter blocked in entry.cond.Wait() wakes up to notice its
+	deadline has elapsed instead of sleeping past it. A zero deadline means
+	wait forever, so it arms nothing. The returned func cancels the timer
+	and must be called once the caller is done waiting. */
+func armDeadline(entry *Entry, deadline time.Time) func() {
+	if deadline.IsZero() {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		entry.Lock()
+		entry.cond.Broadcast()
+		entry.Unlock()
+	})
+	return func() { timer.Stop() }
+}
+
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (self *MemoryLocker) Reserve(key string, deadline time.Time) (LockID, string, error) {
+	self.cache.RLock()
+	entry, ok := self.cache.storage[key]
+	self.cache.RUnlock()
+
+	if !ok {
+		return noLock, "", ErrKeyNotFound
+	}
+
+	cancel := armDeadline(entry, deadline)
+	defer cancel()
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	for entry.lockID != noLock && !entry.deleted && !self.isClosed() {
+		if pastDeadline(deadline) {
+			return noLock, "", ErrReserveTimeout
+		}
+		entry.cond.Wait()
+	}
+	if entry.deleted {
+		return noLock, "", ErrKeyDeleted
+	}
+	if self.isClosed() {
+		return noLock, "", ErrLockerClosed
+	}
+	if pastDeadline(deadline) {
+		return noLock, "", ErrReserveTimeout
+	}
+
+	entry.lockID = uuid()
+	entry.expiry = time.Now().Add(lockTTL)
+	return entry.lockID, entry.value, nil
+}
+
+func (self *MemoryLocker) Set(key, value string) (LockID, error) {
+	for {
+		self.cache.Lock()
+		entry, existed := self.cache.storage[key]
+		if !existed {
+			entry = newEntry()
+			self.cache.storage[key] = entry
+		}
+		self.cache.Unlock()
+
+		entry.Lock()
+
+		// The entry may be tombstoned already - by a Delete that raced
+		// between our lookup above and this Lock, or by one that woke us
+		// from cond.Wait() below - in which case we retry against a
+		// fresh lookup instead of reusing the stale pointer.
+		if entry.deleted {
+			entry.Unlock()
+			continue
+		}
+
+		for existed && entry.lockID != noLock && !entry.deleted && !self.isClosed() {
+			entry.cond.Wait()
+		}
+
+		if entry.deleted {
+			entry.Unlock()
+			continue
+		}
+		if self.isClosed() {
+			entry.Unlock()
+			return noLock, ErrLockerClosed
+		}
+
+		entry.lockID = uuid()
+		entry.expiry = time.Now().Add(lockTTL)
+		entry.value = value
+		entry.Unlock()
+		return entry.lockID, nil
+	}
+}
+
+func (self *MemoryLocker) Update(key string, lockID LockID, value string, release bool) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	self.cache.RLock()
+	entry, ok := self.cache.storage[key]
+	self.cache.RUnlock()
+
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.deleted {
+		return ErrKeyDeleted
+	}
+	if entry.lockID != lockID {
+		return ErrLockMismatch
+	}
+	if time.Now().After(entry.expiry) {
+		return ErrLockExpired
+	}
+
+	entry.value = value
+	if release {
+		entry.lockID = noLock
+		entry.cond.Broadcast()
+	}
+	return nil
+}
+
+func (self *MemoryLocker) Refresh(key string, lockID LockID) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	self.cache.RLock()
+	entry, ok := self.cache.storage[key]
+	self.cache.RUnlock()
+
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.deleted {
+		return ErrKeyDeleted
+	}
+	if entry.lockID != lockID {
+		return ErrLockMismatch
+	}
+	if time.Now().After(entry.expiry) {
+		return ErrLockExpired
+	}
+
+	entry.expiry = time.Now().Add(lockTTL)
+	return nil
+}
+
+/* Delete removes key outright. It holds both the cache write lock and
+	entry's own lock for the whole operation, and marks the entry
+	tombstoned before removing it from the map and broadcasting its cond,
+	so any caller already blocked in Reserve or Set on this entry (looked
+	it up before this Delete ran, then parked on entry.cond.Wait()) wakes
+	up and observes ErrKeyDeleted instead of acting on an entry that is no
+	longer in storage */
+func (self *MemoryLocker) Delete(key string, lockID LockID) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	self.cache.Lock()
+	defer self.cache.Unlock()
+
+	entry, ok := self.cache.storage[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.lockID != lockID {
+		return ErrLockMismatch
+	}
+
+	entry.deleted = true
+	delete(self.cache.storage, key)
+	entry.cond.Broadcast()
+	return nil
+}
+
+/* sweepExpiredLocks periodically walks the cache and clears any lock
+	whose lease has elapsed, waking anyone blocked in Reserve or Set for
+	that key */
+func (self *MemoryLocker) sweepExpiredLocks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+
+		self.cache.RLock()
+		entries := make([]*Entry, 0, len(self.cache.storage))
+		for _, entry := range self.cache.storage {
+			entries = append(entries, entry)
+		}
+		self.cache.RUnlock()
+
+		for _, entry := range entries {
+			entry.Lock()
+			if entry.lockID != noLock && time.Now().After(entry.expiry) {
+				entry.lockID = noLock
+				entry.cond.Broadcast()
+			}
+			entry.Unlock()
+		}
+	}
+}
+
+/* Close wakes every caller currently blocked in Reserve or Set so they
+	return ErrLockerClosed, and stops the expiry sweeper. Server.shutdown
+	calls it once; any later call returns without doing anything. */
+func (self *MemoryLocker) Close() {
+	self.cache.Lock()
+	if self.cache.closed {
+		self.cache.Unlock()
+		return
+	}
+	self.cache.closed = true
+	entries := make([]*Entry, 0, len(self.cache.storage))
+	for _, entry := range self.cache.storage {
+		entries = append(entries, entry)
+	}
+	self.cache.Unlock()
+
+	for _, entry := range entries {
+		entry.Lock()
+		entry.cond.Broadcast()
+		entry.Unlock()
+	}
+	close(self.stop)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/* How long to sleep between retries while polling Redis for a lock that
+	is currently held by someone else. MemoryLocker wakes its waiters via
+	sync.Cond instead, but Redis has no equivalent wake-up signal wired up
+	here, so RedisLocker falls back to polling. */
+const reservePollInterval = 10 * time.Millisecond
+
+/* RedisLocker is a Locker backed by a shared Redis instance, so a fleet
+	of Servers can serve the same keyspace instead of each holding an
+	independent in-process map. Lock acquisition is a single SET key
+	lock_id NX PX ttl, which Redis guarantees is atomic and which expires
+	the lock server-side without needing a sweeper. Update/Refresh/Delete
+	all need to compare the held lock_id before acting, so those run as
+	Lua scripts to keep the compare-and-act atomic instead of racing a
+	separate GET against this process's own SET/DEL. */
+type RedisLocker struct {
+	client *redis.Client
+}
+
+/* NewRedisLocker wraps an already-configured *redis.Client */
+func NewRedisLocker(client *redis.Client) *RedisLocker {
+	return &RedisLocker{client: client}
+}
+
+func lockKey(key string) string  { return "minidb:lock:" + key }
+func valueKey(key string) string { return "minidb:value:" + key }
+
+var updateScript = redis.NewScript(`
+	local lockID = redis.call("GET", KEYS[1])
+	if lockID ~= ARGV[1] then
+		return 0
+	end
+	redis.call("SET", KEYS[2], ARGV[2])
+	if ARGV[3] == "1" then
+		redis.call("DEL", KEYS[1])
+	end
+	return 1
+`)
+
+var refreshScript = redis.NewScript(`
+	local lockID = redis.call("GET", KEYS[1])
+	if lockID ~= ARGV[1] then
+		return 0
+	end
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+`)
+
+var deleteScript = redis.NewScript(`
+	local lockID = redis.call("GET", KEYS[1])
+	if lockID ~= ARGV[1] then
+		return 0
+	end
+	redis.call("DEL", KEYS[1])
+	redis.call("DEL", KEYS[2])
+	return 1
+`)
+
+/* Reserve polls SET NX until it claims key's lock or deadline passes (or
+	forever, if deadline is the zero Time). A real wake-on-release signal
+	would need Redis pub/sub or keyspace notifications wired in alongside
+	this client, which is out of scope here. */
+func (self *RedisLocker) Reserve(key string, deadline time.Time) (LockID, string, error) {
+	ctx := context.Background()
+
+	exists, err := self.client.Exists(ctx, valueKey(key)).Result()
+	if err != nil {
+		return noLock, "", err
+	}
+	if exists == 0 {
+		return noLock, "", ErrKeyNotFound
+	}
+
+	for {
+		lockID := uuid()
+		claimed, err := self.client.SetNX(ctx, lockKey(key), string(lockID), lockTTL).Result()
+		if err != nil {
+			return noLock, "", err
+		}
+		if claimed {
+			value, err := self.client.Get(ctx, valueKey(key)).Result()
+			if err == redis.Nil {
+				self.client.Del(ctx, lockKey(key))
+				return noLock, "", ErrKeyDeleted
+			}
+			if err != nil {
+				return noLock, "", err
+			}
+			return lockID, value, nil
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return noLock, "", ErrReserveTimeout
+		}
+		time.Sleep(reservePollInterval)
+	}
+}
+
+/* Set polls SET NX the same way Reserve does, but always waits for as
+	long as it takes since callers never supply a deadline for it. */
+func (self *RedisLocker) Set(key, value string) (LockID, error) {
+	ctx := context.Background()
+
+	for {
+		lockID := uuid()
+		claimed, err := self.client.SetNX(ctx, lockKey(key), string(lockID), lockTTL).Result()
+		if err != nil {
+			return noLock, err
+		}
+		if claimed {
+			if err := self.client.Set(ctx, valueKey(key), value, 0).Err(); err != nil {
+				return noLock, err
+			}
+			return lockID, nil
+		}
+		time.Sleep(reservePollInterval)
+	}
+}
+
+/* Close is a no-op. It does not stop a Reserve or Set that is already
+	polling Redis in this process: such a call keeps polling until it
+	claims the lock or, for Reserve, its deadline passes, and never returns
+	ErrLockerClosed. The *redis.Client's lifecycle is owned by whoever
+	constructed it. */
+func (self *RedisLocker) Close() {}
+
+func (self *RedisLocker) Update(key string, lockID LockID, value string, release bool) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	ctx := context.Background()
+
+	releaseFlag := "0"
+	if release {
+		releaseFlag = "1"
+	}
+
+	matched, err := updateScript.Run(ctx, self.client,
+		[]string{lockKey(key), valueKey(key)}, string(lockID), value, releaseFlag).Int()
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrLockMismatch
+	}
+	return nil
+}
+
+func (self *RedisLocker) Refresh(key string, lockID LockID) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	ctx := context.Background()
+
+	matched, err := refreshScript.Run(ctx, self.client,
+		[]string{lockKey(key)}, string(lockID), lockTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrLockMismatch
+	}
+	return nil
+}
+
+func (self *RedisLocker) Delete(key string, lockID LockID) error {
+	if lockID == noLock {
+		return ErrInvalidLockID
+	}
+
+	ctx := context.Background()
+
+	matched, err := deleteScript.Run(ctx, self.client,
+		[]string{lockKey(key), valueKey(key)}, string(lockID)).Int()
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrLockMismatch
+	}
+	return nil
+}